@@ -4,45 +4,108 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
+	"crypto/sha512"
 	"encoding/asn1"
-	"encoding/base64"
 	"encoding/binary"
 	"encoding/pem"
 	"flag"
 	"fmt"
 	"github.com/gokyle/cryptobox/secretbox"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"io"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"net/http"
 	"os"
 	"regexp"
+	"strings"
 )
 
+// boxPackage is the on-disk (or on-wire) representation of an sshbox
+// file. It carries one recipientSlot per recipient the box was encrypted
+// to, each independently unwrappable with that recipient's private key,
+// plus the single secretbox payload they all unlock.
 type boxPackage struct {
-	LockedKey []byte
-	Box       []byte
+	Recipients []recipientSlot
+	Box        []byte
+	Signature  signature `asn1:"optional"`
+}
+
+// signature is a detached signature over a box's signingPayload (its Box
+// bytes plus every Recipients fingerprint), binding both the ciphertext
+// and the recipient list to the sender that produced it. Algorithm is
+// empty for boxes made without signcryption, in which case the other
+// fields are unset and there is nothing to verify.
+type signature struct {
+	Algorithm string
+	SignerKey []byte
+	Blob      []byte
 }
 
-type sshPublicKey struct {
-	Algorithm []byte
-	Modulus   []byte
-	Exponent  []byte
+// recipientSlot is one recipient's wrapped copy of a box's key. Fingerprint
+// is the SHA256 fingerprint of the recipient's SSH public key (as produced
+// by ssh.FingerprintSHA256), letting decrypt find the slot that matches
+// whatever private key it was given. Algorithm records how LockedKey was
+// produced so unwrapKey can dispatch to the right routine; an empty
+// Algorithm is treated as "rsa-oaep".
+type recipientSlot struct {
+	Fingerprint  string
+	Algorithm    string
+	LockedKey    []byte
+	EphemeralKey []byte
 }
 
-var pubkeyRegexp = regexp.MustCompile("^ssh-rsa (\\S+).*$")
+// keyFiles collects the repeatable -k flag's values.
+type keyFiles []string
+
+func (k *keyFiles) String() string { return strings.Join(*k, ",") }
+func (k *keyFiles) Set(v string) error {
+	*k = append(*k, v)
+	return nil
+}
+
+const (
+	algRSAOAEP  = "rsa-oaep"
+	algECDHP256 = "ecdh-p256"
+	algECDHP384 = "ecdh-p384"
+	algECDHP521 = "ecdh-p521"
+	algX25519   = "x25519"
+)
+
+const (
+	sigAlgRSAPSS  = "rsa-pss-sha256"
+	sigAlgEd25519 = "ssh-ed25519"
+)
+
 var remoteCheck = regexp.MustCompile("^https?://")
 
 func main() {
 	flArmour := flag.Bool("a", false, "ASCII armour the box")
 	flDecrypt := flag.Bool("d", false, "decrypt file")
 	flEncrypt := flag.Bool("e", false, "encrypt file")
-	flKeyFile := flag.String("k", "", "SSH key file")
+	flStream := flag.Bool("stream", false, "use chunked streaming mode, for files too large to hold in memory")
+	flSignKey := flag.String("s", "", "sign the box with this sender private key (-e only); with -agent, the signer's public key instead")
+	flVerify := flag.Bool("verify", false, "verify the box's signature (-d only)")
+	flSender := flag.String("sender", "", "expected signer's public key, file or URL (-verify only; falls back to -known-signers)")
+	flKnownSigners := flag.String("known-signers", "known_signers", "authorized_keys-style file of trusted signer public keys (-verify only, used when -sender is not given)")
+	flAgent := flag.Bool("agent", false, "use ssh-agent ($SSH_AUTH_SOCK) to sign via -s (-e only). ssh-agent has no key-unwrap operation, so it can't be used to decrypt; -d always needs a private key via -k.")
+	var flKeyFiles keyFiles
+	flag.Var(&flKeyFiles, "k", "SSH public key, authorized_keys-style file, or URL to encrypt to; repeatable. For -d, the single private key to decrypt with.")
 	flag.Parse()
 
 	if *flDecrypt && *flEncrypt {
@@ -58,22 +121,85 @@ func main() {
 	source := flag.Args()[0]
 	target := flag.Args()[1]
 
-	if *flKeyFile == "" {
-		fmt.Println("[!] no key was specified!\n")
+	if *flEncrypt && len(flKeyFiles) == 0 {
+		fmt.Println("[!] no key was specified!")
 		os.Exit(1)
 	}
 
-	remote := remoteCheck.MatchString(*flKeyFile)
-	if remote {
-		if *flDecrypt {
-			fmt.Println("[+] remotely fetching private keys is not allowed.")
-			os.Exit(1)
-		}
-		fmt.Println("[+] will fetch key")
+	if *flDecrypt && *flAgent {
+		fmt.Println("[!] -agent can't decrypt: ssh-agent has no key-unwrap operation. Decrypt with -k and a private key instead.")
+		os.Exit(1)
+	}
+
+	if *flDecrypt && len(flKeyFiles) == 0 {
+		fmt.Println("[!] no key was specified!")
+		os.Exit(1)
+	}
+
+	if *flDecrypt && len(flKeyFiles) > 1 {
+		fmt.Println("[!] -d takes exactly one -k, the recipient's own private key.")
+		os.Exit(1)
+	}
+
+	if *flDecrypt && len(flKeyFiles) == 1 && remoteCheck.MatchString(flKeyFiles[0]) {
+		fmt.Println("[+] remotely fetching private keys is not allowed.")
+		os.Exit(1)
+	}
+
+	if *flEncrypt && *flVerify {
+		fmt.Println("[!] -verify only applies to -d.")
+		os.Exit(1)
+	}
+	if *flDecrypt && *flSignKey != "" {
+		fmt.Println("[!] -s only applies to -e.")
+		os.Exit(1)
+	}
+	if *flStream && *flEncrypt && len(flKeyFiles) != 1 {
+		fmt.Println("[!] -stream doesn't yet support multiple recipients.")
+		os.Exit(1)
+	}
+	if *flStream && (*flSignKey != "" || *flVerify) {
+		fmt.Println("[!] -stream doesn't yet support signcryption.")
+		os.Exit(1)
+	}
+	if *flStream && *flAgent {
+		fmt.Println("[!] -stream doesn't yet support -agent.")
+		os.Exit(1)
+	}
+
+	if *flStream && *flArmour {
+		fmt.Println("[!] -a is not supported with -stream; ignoring -a.")
 	}
 
 	if *flEncrypt {
-		err := encrypt(source, target, *flKeyFile, !remote, *flArmour)
+		var err error
+		if *flStream {
+			local := !remoteCheck.MatchString(flKeyFiles[0])
+			err = encryptStream(source, target, flKeyFiles[0], local)
+		} else {
+			var sign func([]byte) (signature, error)
+			if *flAgent {
+				ag, aerr := dialAgent()
+				if aerr != nil {
+					fmt.Println("[!] failed.")
+					os.Exit(1)
+				}
+				signer, rerr := resolveAgentSigner(ag, *flSignKey)
+				if rerr != nil {
+					fmt.Println("[!] failed.")
+					os.Exit(1)
+				}
+				sign = func(box []byte) (signature, error) { return signBoxWithAgent(signer, box) }
+			} else if *flSignKey != "" {
+				signerKey, serr := loadPrivateKey(*flSignKey)
+				if serr != nil {
+					fmt.Println("[!] failed.")
+					os.Exit(1)
+				}
+				sign = func(box []byte) (signature, error) { return signBox(signerKey, box) }
+			}
+			err = encrypt(source, target, flKeyFiles, sign, *flArmour)
+		}
 		if err != nil {
 			fmt.Println("[!] failed.")
 			os.Exit(1)
@@ -81,7 +207,12 @@ func main() {
 		fmt.Println("[+] success")
 		os.Exit(0)
 	} else {
-		err := decrypt(source, target, *flKeyFile, *flArmour)
+		var err error
+		if *flStream {
+			err = decryptStream(source, target, flKeyFiles[0])
+		} else {
+			err = decrypt(source, target, flKeyFiles[0], *flVerify, *flSender, *flKnownSigners, *flArmour)
+		}
 		if err != nil {
 			fmt.Println("[!] failed.")
 			os.Exit(1)
@@ -107,109 +238,335 @@ func fetchKey(name string, local bool) (kb []byte, err error) {
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			err = fmt.Errorf("fetching %s: %s", name, resp.Status)
+			fmt.Println("[!]", err.Error())
+			return
+		}
+
 		kb, err = ioutil.ReadAll(resp.Body)
 	}
 	return
 }
 
-// Decode a byte slice into an RSA public key.
-func loadPublicKey(name string, local bool) (key *rsa.PublicKey, err error) {
-	kb64, err := fetchKey(name, local)
-
-	kb64 = pubkeyRegexp.ReplaceAll(kb64, []byte("$1"))
-	kb := make([]byte, base64.StdEncoding.DecodedLen(len(kb64)))
-	_, err = base64.StdEncoding.Decode(kb, kb64)
+// loadPublicKey decodes an authorized_keys-formatted public key (as
+// produced by ssh-keygen, or served from e.g. https://github.com/<user>.keys)
+// into the crypto.PublicKey it wraps. RSA, ECDSA (P-256/P-384/P-521), and
+// Ed25519 keys are all supported.
+func loadPublicKey(name string, local bool) (key crypto.PublicKey, err error) {
+	kb, err := fetchKey(name, local)
 	if err != nil {
-		fmt.Println("[!] couldn't decode public key:", err.Error())
 		return
 	}
-	buf := bytes.NewBuffer(kb)
-	var pubKey sshPublicKey
-	var length int32
 
-	err = binary.Read(buf, binary.BigEndian, &length)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(kb)
 	if err != nil {
-		fmt.Println("[!] failed to read public key:", err.Error())
+		fmt.Println("[!] couldn't parse public key:", err.Error())
 		return
 	}
 
-	pubKey.Algorithm = make([]byte, length)
-	_, err = io.ReadFull(buf, pubKey.Algorithm)
+	cryptoKey, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		err = fmt.Errorf("unsupported public key type %q", pub.Type())
+		fmt.Println("[!]", err.Error())
+		return
+	}
+	key = cryptoKey.CryptoPublicKey()
+	return
+}
+
+// loadPublicKeys is like loadPublicKey, but decodes every key in name: a
+// single key, an authorized_keys-style file of many keys (one per line,
+// blank lines and comments ignored), or the same fetched over HTTP, as
+// from https://github.com/<user>.keys.
+func loadPublicKeys(name string, local bool) (keys []crypto.PublicKey, err error) {
+	kb, err := fetchKey(name, local)
 	if err != nil {
-		fmt.Println("[!] failed to decode public key:", err.Error())
 		return
 	}
-	if string(pubKey.Algorithm) != "ssh-rsa" {
-		fmt.Println("[!] invalid public key.")
-		err = fmt.Errorf("invalid public key")
+
+	for _, line := range bytes.Split(kb, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		var pub ssh.PublicKey
+		pub, _, _, _, err = ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			fmt.Println("[!] couldn't parse public key:", err.Error())
+			return
+		}
+
+		cryptoKey, ok := pub.(ssh.CryptoPublicKey)
+		if !ok {
+			err = fmt.Errorf("unsupported public key type %q", pub.Type())
+			fmt.Println("[!]", err.Error())
+			return
+		}
+		keys = append(keys, cryptoKey.CryptoPublicKey())
+	}
+	return
+}
+
+// fingerprintOf returns the SHA256 fingerprint of pub in the same form
+// ssh-keygen prints, used to tell recipientSlots apart.
+func fingerprintOf(pub crypto.PublicKey) (fingerprint string, err error) {
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		fmt.Println("[!] couldn't derive SSH public key for fingerprint:", err.Error())
 		return
 	}
+	return ssh.FingerprintSHA256(sshPub), nil
+}
 
-	err = binary.Read(buf, binary.BigEndian, &length)
+// loadPrivateKey decodes a PEM-encoded OpenSSH private key into the
+// crypto.PrivateKey it wraps. RSA (PKCS#1, PKCS#8, and OPENSSH formats),
+// ECDSA, and Ed25519 keys are all supported. If the key is encrypted, the
+// user is prompted for a passphrase.
+func loadPrivateKey(name string) (key crypto.PrivateKey, err error) {
+	kb, err := fetchKey(name, true)
 	if err != nil {
-		fmt.Println("[!] failed to read public key:", err.Error())
 		return
 	}
-	pubKey.Exponent = make([]byte, length)
-	_, err = io.ReadFull(buf, pubKey.Exponent)
+
+	key, err = ssh.ParseRawPrivateKey(kb)
+	if err == nil {
+		return
+	}
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		fmt.Println("[!] couldn't decode key file:", err.Error())
+		return
+	}
+
+	passphrase, perr := readPassphrase()
+	if perr != nil {
+		err = perr
+		return
+	}
+	key, err = ssh.ParseRawPrivateKeyWithPassphrase(kb, passphrase)
 	if err != nil {
-		fmt.Println("[!] failed to decode public key:", err.Error())
+		fmt.Println("[!] couldn't decode key file:", err.Error())
+	}
+	return
+}
+
+// publicKeyFor returns the public key corresponding to priv, so that a
+// loaded private key can be fingerprinted and matched against a box's
+// recipientSlots.
+func publicKeyFor(priv crypto.PrivateKey) (pub crypto.PublicKey, err error) {
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey, nil
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey, nil
+	case *ed25519.PrivateKey:
+		return key.Public(), nil
+	case ed25519.PrivateKey:
+		return key.Public(), nil
+	default:
+		err = fmt.Errorf("unsupported private key type %T", priv)
+		fmt.Println("[!]", err.Error())
 		return
 	}
+}
 
-	err = binary.Read(buf, binary.BigEndian, &length)
+// readPassphrase prompts the user for the passphrase protecting an
+// encrypted private key.
+func readPassphrase() ([]byte, error) {
+	fmt.Print("Key passphrase: ")
+	var passphrase string
+	_, err := fmt.Scanln(&passphrase)
 	if err != nil {
-		fmt.Println("[!] failed to read public key:", err.Error())
+		return nil, err
+	}
+	return []byte(passphrase), nil
+}
+
+// wrapKey wraps boxKey for the given recipient public key, returning the
+// algorithm identifier used, the wrapped key, and - for the ECDH
+// algorithms - the sender's ephemeral public key the recipient needs to
+// redo the exchange.
+func wrapKey(pub crypto.PublicKey, boxKey []byte) (alg string, lockedKey, ephemeralKey []byte, err error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		hash := sha256.New()
+		lockedKey, err = rsa.EncryptOAEP(hash, rand.Reader, pub, boxKey, nil)
+		if err != nil {
+			fmt.Println("[!] RSA encryption failed:", err.Error())
+			return
+		}
+		alg = algRSAOAEP
+		return
+	case *ecdsa.PublicKey:
+		return wrapKeyECDH(pub, boxKey)
+	case ed25519.PublicKey:
+		return wrapKeyX25519(pub, boxKey)
+	default:
+		err = fmt.Errorf("unsupported recipient key type %T", pub)
+		fmt.Println("[!]", err.Error())
+		return
+	}
+}
+
+// wrapKeyECDH performs an ephemeral-static ECDH exchange against an ECDSA
+// recipient key, runs the shared secret through HKDF-SHA256 to derive a
+// key-encryption key, and uses it to AEAD-wrap boxKey.
+func wrapKeyECDH(pub *ecdsa.PublicKey, boxKey []byte) (alg string, lockedKey, ephemeralKey []byte, err error) {
+	curve := pub.Curve
+	switch curve {
+	case elliptic.P256():
+		alg = algECDHP256
+	case elliptic.P384():
+		alg = algECDHP384
+	case elliptic.P521():
+		alg = algECDHP521
+	default:
+		err = fmt.Errorf("unsupported ECDSA curve")
+		fmt.Println("[!]", err.Error())
 		return
 	}
-	pubKey.Modulus = make([]byte, length)
-	_, err = io.ReadFull(buf, pubKey.Modulus)
+
+	ephPriv, ephX, ephY, err := elliptic.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		fmt.Println("[!] failed to decode public key:", err.Error())
+		fmt.Println("[!] failed to generate ephemeral key:", err.Error())
 		return
 	}
+	ephemeralKey = elliptic.Marshal(curve, ephX, ephY)
 
-	key = new(rsa.PublicKey)
-	key.N = new(big.Int).SetBytes(pubKey.Modulus)
-	key.E = int(new(big.Int).SetBytes(pubKey.Exponent).Int64())
+	sharedX, _ := curve.ScalarMult(pub.X, pub.Y, ephPriv)
+
+	kek, err := deriveSecretboxKey(sharedX.Bytes(), 32)
+	if err != nil {
+		return
+	}
+	lockedKey, err = aeadWrap(kek, boxKey)
 	return
 }
 
-// Decode a byte slice into an RSA private key. Note that OpenSSH
-// private keys are in PEM format.
-func loadPrivateKey(name string) (key *rsa.PrivateKey, err error) {
-	kb, err := fetchKey(name, true)
-	block, _ := pem.Decode(kb)
-	if block == nil {
-		fmt.Println("[!] couldn't decode key file.")
-		os.Exit(1)
-	} else if block.Type != "RSA PRIVATE KEY" {
-		fmt.Println("[!] key is not a private key.")
-		os.Exit(1)
+// wrapKeyX25519 converts an Ed25519 recipient key to Curve25519, performs
+// an ephemeral-static X25519 exchange, derives a key-encryption key via
+// HKDF-SHA256, and uses it to AEAD-wrap boxKey.
+func wrapKeyX25519(pub ed25519.PublicKey, boxKey []byte) (alg string, lockedKey, ephemeralKey []byte, err error) {
+	recipientX, err := ed25519PublicKeyToCurve25519(pub)
+	if err != nil {
+		fmt.Println("[!]", err.Error())
+		return
+	}
+
+	var ephPriv [32]byte
+	if _, err = io.ReadFull(rand.Reader, ephPriv[:]); err != nil {
+		fmt.Println("[!] failed to generate ephemeral key:", err.Error())
+		return
 	}
 
-	key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	var ephPub [32]byte
+	curve25519.ScalarBaseMult(&ephPub, &ephPriv)
+	ephemeralKey = ephPub[:]
+
+	var shared [32]byte
+	curve25519.ScalarMult(&shared, &ephPriv, &recipientX)
+
+	kek, err := deriveSecretboxKey(shared[:], 32)
+	if err != nil {
+		return
+	}
+	lockedKey, err = aeadWrap(kek, boxKey)
+	alg = algX25519
 	return
+}
 
+// deriveSecretboxKey runs an ECDH shared secret through HKDF-SHA256 to
+// produce a key suitable for use with secretbox or as an AES-256 KEK.
+func deriveSecretboxKey(secret []byte, size int) ([]byte, error) {
+	kdf := hkdf.New(sha256.New, secret, nil, []byte("sshbox secretbox key"))
+	key := make([]byte, size)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		fmt.Println("[!] key derivation failed:", err.Error())
+		return nil, err
+	}
+	return key, nil
 }
 
-// Generate a random box key, encrypt the key to the RSA public key,
-// package the box appropriately, and write it out to a file.
-func encrypt(in, out, keyfile string, local, armour bool) (err error) {
-	pub, err := loadPublicKey(keyfile, local)
+// aeadWrap encrypts plaintext under an AES-256-GCM key, for key wrapping
+// in the ECDH-derived algorithms. The output is the random nonce followed
+// by the sealed ciphertext.
+func aeadWrap(kek, plaintext []byte) ([]byte, error) {
+	gcm, err := newStreamGCM(kek)
 	if err != nil {
-		return
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		fmt.Println("[!] failed to generate wrap nonce:", err.Error())
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// aeadUnwrap reverses aeadWrap.
+func aeadUnwrap(kek, wrapped []byte) ([]byte, error) {
+	gcm, err := newStreamGCM(kek)
+	if err != nil {
+		return nil, err
 	}
+	if len(wrapped) < gcm.NonceSize() {
+		err = fmt.Errorf("wrapped key is too short")
+		fmt.Println("[!]", err.Error())
+		return nil, err
+	}
+	nonce, ciphertext := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		fmt.Println("[!] failed to unwrap key:", err.Error())
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// Generate a random box key, wrap it once per recipient across all of
+// keyfiles, package the box, and write it out to a file. Each entry in
+// keyfiles may be a single public key, an authorized_keys-style file of
+// several keys, or a URL such as https://github.com/<user>.keys. If sign
+// is non-nil, it is called on the box's signingPayload and the signature
+// it returns is embedded in the box.
+func encrypt(in, out string, keyfiles []string, sign func(box []byte) (signature, error), armour bool) (err error) {
 	boxKey, err := secretbox.GenerateKey()
 	if err != nil {
 		fmt.Println("[!] failed to generate the box key.")
 		return
 	}
 
-	hash := sha256.New()
-	lockedKey, err := rsa.EncryptOAEP(hash, rand.Reader, pub, boxKey, nil)
-	if err != nil {
-		fmt.Println("[!] RSA encryption failed:", err.Error())
+	var recipients []recipientSlot
+	for _, keyfile := range keyfiles {
+		local := !remoteCheck.MatchString(keyfile)
+		pubs, perr := loadPublicKeys(keyfile, local)
+		if perr != nil {
+			err = perr
+			return
+		}
+		if len(pubs) == 0 {
+			fmt.Printf("[!] %s contained no usable keys; skipping.\n", keyfile)
+			continue
+		}
+
+		for _, pub := range pubs {
+			fingerprint, ferr := fingerprintOf(pub)
+			if ferr != nil {
+				err = ferr
+				return
+			}
+			alg, lockedKey, ephemeralKey, werr := wrapKey(pub, boxKey)
+			if werr != nil {
+				err = werr
+				return
+			}
+			recipients = append(recipients, recipientSlot{fingerprint, alg, lockedKey, ephemeralKey})
+		}
+	}
+
+	if len(recipients) == 0 {
+		err = fmt.Errorf("no recipients: none of the given -k keys yielded a usable public key")
+		fmt.Println("[!]", err.Error())
 		return
 	}
 
@@ -225,7 +582,16 @@ func encrypt(in, out, keyfile string, local, armour bool) (err error) {
 		err = fmt.Errorf("sealing failure")
 		return
 	}
-	pkg, err := packageBox(lockedKey, box, armour)
+
+	var sig signature
+	if sign != nil {
+		sig, err = sign(signingPayload(recipients, box))
+		if err != nil {
+			return
+		}
+	}
+
+	pkg, err := packageBox(recipients, box, sig, armour)
 	if err != nil {
 		return
 	}
@@ -239,8 +605,8 @@ func encrypt(in, out, keyfile string, local, armour bool) (err error) {
 
 // packageBox actually handles boxing. It can output either PEM-encoded or
 // DER-encoded boxes.
-func packageBox(lockedKey, box []byte, armour bool) (pkg []byte, err error) {
-	var pkgBox = boxPackage{lockedKey, box}
+func packageBox(recipients []recipientSlot, box []byte, sig signature, armour bool) (pkg []byte, err error) {
+	var pkgBox = boxPackage{recipients, box, sig}
 
 	pkg, err = asn1.Marshal(pkgBox)
 	if err != nil {
@@ -257,29 +623,385 @@ func packageBox(lockedKey, box []byte, armour bool) (pkg []byte, err error) {
 	return
 }
 
-// Decrypt loads the box, recovers the key using the RSA private key, open
-// the box, and write the message to a file.
-func decrypt(in, out, keyfile string, armour bool) (err error) {
+// signingPayload returns the bytes signBox/signBoxWithAgent/
+// verifyBoxSignature sign and verify over: a SHA-256 digest of every
+// recipient's fingerprint, in order, followed by the box ciphertext.
+// Binding the recipient
+// list in prevents an intermediary from stripping or adding
+// recipientSlots to a signed box without invalidating the signature
+// (surreptitious forwarding).
+func signingPayload(recipients []recipientSlot, box []byte) []byte {
+	h := sha256.New()
+	for _, r := range recipients {
+		h.Write([]byte(r.Fingerprint))
+		h.Write([]byte{0})
+	}
+	h.Write(box)
+	return h.Sum(nil)
+}
+
+// signBox signs payload (see signingPayload) with signerKey, returning
+// the signature to embed in the boxPackage. RSA signers use RSA-PSS over
+// SHA-256; Ed25519 signers sign payload directly, as is conventional for
+// that algorithm.
+func signBox(signerKey crypto.PrivateKey, payload []byte) (sig signature, err error) {
+	switch key := signerKey.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(payload)
+		sig.Blob, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+		if err != nil {
+			fmt.Println("[!] failed to sign box:", err.Error())
+			return
+		}
+		sig.Algorithm = sigAlgRSAPSS
+	case *ed25519.PrivateKey:
+		sig.Blob = ed25519.Sign(*key, payload)
+		sig.Algorithm = sigAlgEd25519
+	case ed25519.PrivateKey:
+		sig.Blob = ed25519.Sign(key, payload)
+		sig.Algorithm = sigAlgEd25519
+	default:
+		err = fmt.Errorf("unsupported signing key type %T", signerKey)
+		fmt.Println("[!]", err.Error())
+		return
+	}
+
+	signerPub, err := publicKeyFor(signerKey)
+	if err != nil {
+		return
+	}
+	sshPub, err := ssh.NewPublicKey(signerPub)
+	if err != nil {
+		fmt.Println("[!] couldn't derive SSH public key for signer:", err.Error())
+		return
+	}
+	sig.SignerKey = sshPub.Marshal()
+	return
+}
+
+// resolveAgentSigner picks the ssh.Signer in ag to sign with. selector, if
+// given, is the path or URL to the signer's public key, used to tell
+// identities apart when the agent holds more than one; with no selector,
+// the agent must hold exactly one identity.
+func resolveAgentSigner(ag agent.Agent, selector string) (signer ssh.Signer, err error) {
+	signers, err := agentSigners(ag)
+	if err != nil {
+		return
+	}
+
+	if selector == "" {
+		if len(signers) > 1 {
+			err = fmt.Errorf("ssh-agent holds more than one identity; use -s to pick one by public key")
+			fmt.Println("[!]", err.Error())
+			return
+		}
+		return signers[0], nil
+	}
+
+	pub, err := loadPublicKey(selector, !remoteCheck.MatchString(selector))
+	if err != nil {
+		return
+	}
+	fingerprint, err := fingerprintOf(pub)
+	if err != nil {
+		return
+	}
+	for _, s := range signers {
+		if ssh.FingerprintSHA256(s.PublicKey()) == fingerprint {
+			return s, nil
+		}
+	}
+	err = fmt.Errorf("ssh-agent has no identity matching %s", selector)
+	fmt.Println("[!]", err.Error())
+	return
+}
+
+// signBoxWithAgent signs payload (see signingPayload) using signer, an
+// identity held by ssh-agent. Unlike signBox, the private key never
+// leaves the agent: the agent signs on sshbox's behalf and returns the
+// SSH wire-format signature, which is stored as-is.
+func signBoxWithAgent(signer ssh.Signer, payload []byte) (sig signature, err error) {
+	sshSig, err := signer.Sign(rand.Reader, payload)
+	if err != nil {
+		fmt.Println("[!] agent refused to sign box:", err.Error())
+		return
+	}
+	sig.Algorithm = sshSig.Format
+	sig.SignerKey = signer.PublicKey().Marshal()
+	sig.Blob = sshSig.Blob
+	return
+}
+
+// verifyBoxSignature checks that sig is a valid signature over payload
+// (see signingPayload), produced by a key in trusted. It returns the
+// signer's fingerprint on success.
+func verifyBoxSignature(sig signature, payload []byte, trusted []crypto.PublicKey) (fingerprint string, err error) {
+	if sig.Algorithm == "" {
+		err = fmt.Errorf("box is not signed")
+		fmt.Println("[!]", err.Error())
+		return
+	}
+
+	sshPub, err := ssh.ParsePublicKey(sig.SignerKey)
+	if err != nil {
+		fmt.Println("[!] couldn't parse signer key:", err.Error())
+		return
+	}
+	cryptoKey, ok := sshPub.(ssh.CryptoPublicKey)
+	if !ok {
+		err = fmt.Errorf("unsupported signer key type %q", sshPub.Type())
+		fmt.Println("[!]", err.Error())
+		return
+	}
+	signerPub := cryptoKey.CryptoPublicKey()
+
+	fingerprint, err = fingerprintOf(signerPub)
+	if err != nil {
+		return
+	}
+	if !trustsFingerprint(trusted, fingerprint) {
+		err = fmt.Errorf("signer %s is not trusted", fingerprint)
+		fmt.Println("[!]", err.Error())
+		return
+	}
+
+	switch sig.Algorithm {
+	case sigAlgRSAPSS:
+		rsaKey, ok := signerPub.(*rsa.PublicKey)
+		if !ok {
+			err = fmt.Errorf("signature requires an RSA signer key")
+			fmt.Println("[!]", err.Error())
+			return
+		}
+		digest := sha256.Sum256(payload)
+		if verr := rsa.VerifyPSS(rsaKey, crypto.SHA256, digest[:], sig.Blob, nil); verr != nil {
+			err = fmt.Errorf("signature verification failed: %s", verr.Error())
+			fmt.Println("[!]", err.Error())
+			return
+		}
+	case sigAlgEd25519:
+		edKey, ok := signerPub.(ed25519.PublicKey)
+		if !ok {
+			err = fmt.Errorf("signature requires an Ed25519 signer key")
+			fmt.Println("[!]", err.Error())
+			return
+		}
+		if !ed25519.Verify(edKey, payload, sig.Blob) {
+			err = fmt.Errorf("signature verification failed")
+			fmt.Println("[!]", err.Error())
+			return
+		}
+	default:
+		// Anything else is assumed to be an SSH wire-format signature, as
+		// produced by an ssh.Signer (e.g. one backed by ssh-agent) rather
+		// than sshbox's own RSA-PSS/Ed25519 signing. This path also covers
+		// ECDSA signers, which sshbox can't sign with directly but an
+		// agent can.
+		sshSig := ssh.Signature{Format: sig.Algorithm, Blob: sig.Blob}
+		if verr := sshPub.Verify(payload, &sshSig); verr != nil {
+			err = fmt.Errorf("signature verification failed: %s", verr.Error())
+			fmt.Println("[!]", err.Error())
+			return
+		}
+	}
+	return
+}
+
+// trustsFingerprint reports whether any key in trusted has the given
+// fingerprint.
+func trustsFingerprint(trusted []crypto.PublicKey, fingerprint string) bool {
+	for _, pub := range trusted {
+		if fp, err := fingerprintOf(pub); err == nil && fp == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// dialAgent connects to the ssh-agent listening on $SSH_AUTH_SOCK, so that
+// sshbox can use agent-resident keys (hardware tokens, FIDO sk-* keys,
+// forwarded agents) without the private key material ever entering this
+// process.
+func dialAgent() (agent.ExtendedAgent, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		err := fmt.Errorf("SSH_AUTH_SOCK is not set; is ssh-agent running?")
+		fmt.Println("[!]", err.Error())
+		return nil, err
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		fmt.Println("[!] couldn't connect to ssh-agent:", err.Error())
+		return nil, err
+	}
+	return agent.NewClient(conn).(agent.ExtendedAgent), nil
+}
+
+// agentSigners lists the identities ag currently holds.
+func agentSigners(ag agent.Agent) (signers []ssh.Signer, err error) {
+	signers, err = ag.Signers()
+	if err != nil {
+		fmt.Println("[!] couldn't list ssh-agent identities:", err.Error())
+		return
+	}
+	if len(signers) == 0 {
+		err = fmt.Errorf("ssh-agent has no identities loaded")
+		fmt.Println("[!]", err.Error())
+	}
+	return
+}
+
+// unwrapKey recovers the secretbox key for priv from the wrapped key
+// material in a recipientSlot, dispatching on the algorithm the slot was
+// packaged with. Slots with no algorithm set are assumed to be RSA-OAEP.
+func unwrapKey(alg string, priv crypto.PrivateKey, lockedKey, ephemeralKey []byte) (boxKey []byte, err error) {
+	if alg == "" {
+		alg = algRSAOAEP
+	}
+
+	switch alg {
+	case algRSAOAEP:
+		rsaKey, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			err = fmt.Errorf("box requires an RSA key")
+			fmt.Println("[!]", err.Error())
+			return
+		}
+		hash := sha256.New()
+		boxKey, err = rsa.DecryptOAEP(hash, rand.Reader, rsaKey, lockedKey, nil)
+		if err != nil {
+			fmt.Println("[!] RSA decryption failed:", err.Error())
+		}
+		return
+	case algECDHP256, algECDHP384, algECDHP521:
+		ecKey, ok := priv.(*ecdsa.PrivateKey)
+		if !ok {
+			err = fmt.Errorf("box requires an ECDSA key")
+			fmt.Println("[!]", err.Error())
+			return
+		}
+		curve := ecKey.Curve
+		ephX, ephY := elliptic.Unmarshal(curve, ephemeralKey)
+		if ephX == nil {
+			err = fmt.Errorf("invalid ephemeral key in box")
+			fmt.Println("[!]", err.Error())
+			return
+		}
+		sharedX, _ := curve.ScalarMult(ephX, ephY, ecKey.D.Bytes())
+		kek, derr := deriveSecretboxKey(sharedX.Bytes(), 32)
+		if derr != nil {
+			err = derr
+			return
+		}
+		boxKey, err = aeadUnwrap(kek, lockedKey)
+		return
+	case algX25519:
+		var edKey ed25519.PrivateKey
+		switch k := priv.(type) {
+		case *ed25519.PrivateKey:
+			edKey = *k
+		case ed25519.PrivateKey:
+			edKey = k
+		default:
+			err = fmt.Errorf("box requires an Ed25519 key")
+			fmt.Println("[!]", err.Error())
+			return
+		}
+		recipientX, cerr := ed25519PrivateKeyToCurve25519(edKey)
+		if cerr != nil {
+			err = cerr
+			fmt.Println("[!]", err.Error())
+			return
+		}
+		var ephPub, shared [32]byte
+		copy(ephPub[:], ephemeralKey)
+		curve25519.ScalarMult(&shared, &recipientX, &ephPub)
+		kek, derr := deriveSecretboxKey(shared[:], 32)
+		if derr != nil {
+			err = derr
+			return
+		}
+		boxKey, err = aeadUnwrap(kek, lockedKey)
+		return
+	default:
+		err = fmt.Errorf("unsupported box algorithm %q", alg)
+		fmt.Println("[!]", err.Error())
+		return
+	}
+}
+
+// findRecipient returns the recipientSlot in recipients matching
+// fingerprint, if any. A lone recipient with no Fingerprint is a legacy
+// box (see legacyBoxPackage), which predates per-recipient fingerprints
+// and matches whatever key it's given.
+func findRecipient(recipients []recipientSlot, fingerprint string) (slot recipientSlot, found bool) {
+	if len(recipients) == 1 && recipients[0].Fingerprint == "" {
+		return recipients[0], true
+	}
+	for _, r := range recipients {
+		if r.Fingerprint == fingerprint {
+			return r, true
+		}
+	}
+	return
+}
+
+// Decrypt loads the box, finds the recipientSlot matching the private
+// key's fingerprint, recovers the box key, opens the box, and writes the
+// message to a file. If verify is set, the box's signature is checked
+// against senderKeyfile (if given) or, failing that, against the
+// authorized_keys-style knownSignersFile before the plaintext is written.
+func decrypt(in, out, keyfile string, verify bool, senderKeyfile, knownSignersFile string, armour bool) (err error) {
 	key, err := loadPrivateKey(keyfile)
 	if err != nil {
 		return
 	}
 
+	pub, err := publicKeyFor(key)
+	if err != nil {
+		return
+	}
+	fingerprint, err := fingerprintOf(pub)
+	if err != nil {
+		return
+	}
+
 	pkg, err := ioutil.ReadFile(in)
 	if err != nil {
 		fmt.Println("[!]", err.Error())
 		return
 	}
 
-	lockedKey, box, err := unpackageBox(pkg)
+	recipients, box, sig, err := unpackageBox(pkg)
 	if err != nil {
 		return
 	}
 
-	hash := sha256.New()
-	boxKey, err := rsa.DecryptOAEP(hash, rand.Reader, key, lockedKey, nil)
+	if verify {
+		var trusted []crypto.PublicKey
+		if senderKeyfile != "" {
+			trusted, err = loadPublicKeys(senderKeyfile, !remoteCheck.MatchString(senderKeyfile))
+		} else {
+			trusted, err = loadPublicKeys(knownSignersFile, true)
+		}
+		if err != nil {
+			return
+		}
+		if _, err = verifyBoxSignature(sig, signingPayload(recipients, box), trusted); err != nil {
+			return
+		}
+	}
+
+	slot, found := findRecipient(recipients, fingerprint)
+	if !found {
+		fmt.Println("[!] this box wasn't encrypted to the given key.")
+		err = fmt.Errorf("no matching recipient")
+		return
+	}
+
+	boxKey, err := unwrapKey(slot.Algorithm, key, slot.LockedKey, slot.EphemeralKey)
 	if err != nil {
-		fmt.Println("[!] RSA decryption failed:", err.Error())
 		return
 	}
 
@@ -293,23 +1015,399 @@ func decrypt(in, out, keyfile string, armour bool) (err error) {
 	return
 }
 
-// unpackageBox handles the loading of a box; it first attempts to decode the
-// box as a DER-encoded box. If this fails, it attempts to decode the box as
-// a PEM-encoded box.
-func unpackageBox(pkg []byte) (lockedKey, box []byte, err error) {
+// unpackageBox handles the loading of a box; it first checks whether pkg is
+// PEM-encoded, unwrapping it to the raw DER bytes if so, and otherwise
+// treats pkg itself as DER. Either way, if the current boxPackage shape
+// doesn't parse it falls back to legacyBoxPackage, so boxes made by
+// pre-recipient-list sshbox binaries still open.
+func unpackageBox(pkg []byte) (recipients []recipientSlot, box []byte, sig signature, err error) {
+	block, _ := pem.Decode(pkg)
+	der := pkg
+	if block != nil {
+		if block.Type != "SSHBOX ENCRYPTED FILE" {
+			fmt.Println("[!] invalid box.")
+			err = fmt.Errorf("invalid box")
+			return
+		}
+		der = block.Bytes
+	}
+
 	var pkgStruct boxPackage
+	if _, uerr := asn1.Unmarshal(der, &pkgStruct); uerr == nil {
+		return pkgStruct.Recipients, pkgStruct.Box, pkgStruct.Signature, nil
+	}
 
-	_, err = asn1.Unmarshal(pkg, &pkgStruct)
-	if err == nil {
-		return pkgStruct.LockedKey, pkgStruct.Box, nil
+	var legacy legacyBoxPackage
+	if _, uerr := asn1.Unmarshal(der, &legacy); uerr == nil {
+		recipients = []recipientSlot{{Algorithm: algRSAOAEP, LockedKey: legacy.LockedKey}}
+		return recipients, legacy.Box, signature{}, nil
 	}
 
-	block, _ := pem.Decode(pkg)
-	if block == nil || block.Type != "SSHBOX ENCRYPTED FILE" {
-		fmt.Println("[!] invalid box.")
-		err = fmt.Errorf("invalid box")
+	fmt.Println("[!] invalid box.")
+	err = fmt.Errorf("invalid box")
+	return
+}
+
+// legacyBoxPackage is the on-disk shape used before sshbox grew
+// multi-recipient support: a single RSA-OAEP-wrapped key alongside the
+// secretbox payload, with no fingerprint to match against. unpackageBox
+// falls back to this shape, and decrypt treats its one recipientSlot
+// (Fingerprint left empty) as matching whatever private key it's given.
+type legacyBoxPackage struct {
+	LockedKey []byte
+	Box       []byte
+}
+
+// streamChunkSize is the amount of plaintext sealed into each AES-GCM
+// chunk of a streamed box. Keeping it well below typical memory budgets
+// lets EncryptStream/DecryptStream handle multi-GB files without holding
+// more than a chunk in memory at a time.
+const streamChunkSize = 64 * 1024
+
+// gcmNonceSize is the nonce size AES-GCM expects.
+const gcmNonceSize = 12
+
+// streamHeader is the header written at the start of a streamed box. It
+// carries the same key-wrap fields as a recipientSlot; the sealed payload
+// follows as a sequence of length-prefixed chunk frames rather than a
+// single Box field.
+type streamHeader struct {
+	Algorithm    string
+	LockedKey    []byte
+	EphemeralKey []byte
+	NonceBase    []byte
+}
+
+// encryptStream loads the recipient's public key, wraps a fresh stream
+// key to it, and pipes in to out as a chunked AES-GCM stream.
+func encryptStream(in, out, keyfile string, local bool) (err error) {
+	pubs, err := loadPublicKeys(keyfile, local)
+	if err != nil {
+		return
+	}
+	if len(pubs) != 1 {
+		err = fmt.Errorf("-stream needs exactly one recipient key, but %s holds %d", keyfile, len(pubs))
+		fmt.Println("[!]", err.Error())
+		return
+	}
+	pub := pubs[0]
+
+	src, err := os.Open(in)
+	if err != nil {
+		fmt.Println("[!]", err.Error())
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.Create(out)
+	if err != nil {
+		fmt.Println("[!]", err.Error())
+		return
+	}
+	defer dst.Close()
+
+	return EncryptStream(dst, src, pub)
+}
+
+// decryptStream loads the recipient's private key and pipes in to out,
+// reversing encryptStream.
+func decryptStream(in, out, keyfile string) (err error) {
+	key, err := loadPrivateKey(keyfile)
+	if err != nil {
 		return
 	}
-	_, err = asn1.Unmarshal(block.Bytes, &pkgStruct)
-	return pkgStruct.LockedKey, pkgStruct.Box, err
-}
\ No newline at end of file
+
+	src, err := os.Open(in)
+	if err != nil {
+		fmt.Println("[!]", err.Error())
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.Create(out)
+	if err != nil {
+		fmt.Println("[!]", err.Error())
+		return
+	}
+	defer dst.Close()
+
+	return DecryptStream(dst, src, key)
+}
+
+// EncryptStream wraps a fresh AES-256 stream key to pub, writes the
+// resulting header to dst, then reads src in streamChunkSize chunks,
+// sealing each with AES-256-GCM under a nonce derived from the header's
+// base nonce XORed with the chunk counter. Each sealed chunk is written to
+// dst as a length-prefixed frame; the AAD of the last chunk is flagged so
+// DecryptStream can detect a truncated stream.
+func EncryptStream(dst io.Writer, src io.Reader, pub crypto.PublicKey) (err error) {
+	cek := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, cek); err != nil {
+		fmt.Println("[!] failed to generate the stream key:", err.Error())
+		return
+	}
+
+	alg, lockedKey, ephemeralKey, err := wrapKey(pub, cek)
+	if err != nil {
+		return
+	}
+
+	nonceBase := make([]byte, gcmNonceSize)
+	if _, err = io.ReadFull(rand.Reader, nonceBase); err != nil {
+		fmt.Println("[!] failed to generate the nonce base:", err.Error())
+		return
+	}
+
+	gcm, err := newStreamGCM(cek)
+	if err != nil {
+		return
+	}
+
+	if err = writeStreamHeader(dst, alg, lockedKey, ephemeralKey, nonceBase); err != nil {
+		return
+	}
+
+	reader := bufio.NewReaderSize(src, streamChunkSize)
+	var counter uint64
+	for {
+		buf := make([]byte, streamChunkSize)
+		n, rerr := io.ReadFull(reader, buf)
+		if rerr != nil && rerr != io.ErrUnexpectedEOF && rerr != io.EOF {
+			fmt.Println("[!] failed to read input:", rerr.Error())
+			return rerr
+		}
+		buf = buf[:n]
+
+		_, peekErr := reader.Peek(1)
+		final := peekErr != nil
+
+		nonce := chunkNonce(nonceBase, counter)
+		sealed := gcm.Seal(nil, nonce, buf, chunkAAD(counter, final))
+		if err = writeFrame(dst, sealed); err != nil {
+			return
+		}
+
+		counter++
+		if final {
+			break
+		}
+	}
+	return nil
+}
+
+// DecryptStream reads a header written by EncryptStream, recovers the
+// stream key for priv, and verifies and decrypts each chunk frame in
+// turn, writing the recovered plaintext to dst. It returns an error if
+// any chunk fails authentication or if the stream ends without a frame
+// flagged as final, which would otherwise let an attacker truncate a box
+// undetected.
+func DecryptStream(dst io.Writer, src io.Reader, priv crypto.PrivateKey) (err error) {
+	br := bufio.NewReaderSize(src, streamChunkSize)
+
+	hdr, err := readStreamHeader(br)
+	if err != nil {
+		return
+	}
+
+	cek, err := unwrapKey(hdr.Algorithm, priv, hdr.LockedKey, hdr.EphemeralKey)
+	if err != nil {
+		return
+	}
+
+	gcm, err := newStreamGCM(cek)
+	if err != nil {
+		return
+	}
+
+	var counter uint64
+	for {
+		sealed, rerr := readFrame(br)
+		if rerr != nil {
+			fmt.Println("[!] failed to read stream frame:", rerr.Error())
+			return rerr
+		}
+
+		_, peekErr := br.Peek(1)
+		final := peekErr != nil
+
+		nonce := chunkNonce(hdr.NonceBase, counter)
+		plain, oerr := gcm.Open(nil, nonce, sealed, chunkAAD(counter, final))
+		if oerr != nil {
+			err = fmt.Errorf("chunk %d failed to decrypt: %s", counter, oerr.Error())
+			fmt.Println("[!]", err.Error())
+			return
+		}
+		if _, werr := dst.Write(plain); werr != nil {
+			fmt.Println("[!]", werr.Error())
+			return werr
+		}
+
+		counter++
+		if final {
+			break
+		}
+	}
+	return nil
+}
+
+// newStreamGCM builds the AES-256-GCM instance chunks are sealed/opened
+// under for a given stream key.
+func newStreamGCM(cek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		fmt.Println("[!]", err.Error())
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		fmt.Println("[!]", err.Error())
+		return nil, err
+	}
+	return gcm, nil
+}
+
+// chunkNonce derives the per-chunk AES-GCM nonce by XORing the chunk
+// counter into the low 8 bytes of the stream's base nonce.
+func chunkNonce(base []byte, counter uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], counter)
+	for i := range ctr {
+		nonce[len(nonce)-8+i] ^= ctr[i]
+	}
+	return nonce
+}
+
+// chunkAAD binds a chunk's ciphertext to its position in the stream and
+// to whether it is the final chunk, so that chunks cannot be reordered,
+// dropped, or have the stream truncated without detection.
+func chunkAAD(counter uint64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad[:8], counter)
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// writeStreamHeader ASN.1-marshals a streamHeader and writes it to w as a
+// length-prefixed frame, ahead of the chunk frames that follow it.
+func writeStreamHeader(w io.Writer, alg string, lockedKey, ephemeralKey, nonceBase []byte) error {
+	hdr := streamHeader{alg, lockedKey, ephemeralKey, nonceBase}
+	der, err := asn1.Marshal(hdr)
+	if err != nil {
+		fmt.Println("[!] couldn't package the stream header")
+		return err
+	}
+	return writeFrame(w, der)
+}
+
+// readStreamHeader reads the length-prefixed frame written by
+// writeStreamHeader and unmarshals it back into a streamHeader.
+func readStreamHeader(r io.Reader) (hdr streamHeader, err error) {
+	der, err := readFrame(r)
+	if err != nil {
+		fmt.Println("[!] failed to read stream header:", err.Error())
+		return
+	}
+	_, err = asn1.Unmarshal(der, &hdr)
+	return
+}
+
+// writeFrame writes data to w as a 4-byte big-endian length prefix
+// followed by data itself.
+func writeFrame(w io.Writer, data []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		fmt.Println("[!] failed to write stream frame:", err.Error())
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		fmt.Println("[!] failed to write stream frame:", err.Error())
+		return err
+	}
+	return nil
+}
+
+// readFrame reads a single frame written by writeFrame: a 4-byte
+// big-endian length prefix followed by that many bytes of data.
+func readFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		fmt.Println("[!] failed to read stream frame:", err.Error())
+		return nil, err
+	}
+	return data, nil
+}
+
+// ed25519FieldPrime is 2^255 - 19, the prime over which Curve25519 and
+// Edwards25519 are defined.
+var ed25519FieldPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// ed25519PublicKeyToCurve25519 birationally maps an Ed25519 public key to
+// its corresponding Curve25519 (Montgomery form) public key, via
+// u = (1+y)/(1-y) mod p, so that Ed25519 recipient keys can be used for
+// X25519 key exchange.
+func ed25519PublicKeyToCurve25519(pub ed25519.PublicKey) (out [32]byte, err error) {
+	if len(pub) != ed25519.PublicKeySize {
+		err = fmt.Errorf("invalid ed25519 public key")
+		return
+	}
+
+	buf := make([]byte, ed25519.PublicKeySize)
+	copy(buf, pub)
+	buf[31] &= 0x7f // clear the sign bit; the rest encodes y, little-endian
+
+	y := new(big.Int).SetBytes(reverseBytes(buf))
+
+	one := big.NewInt(1)
+	numerator := new(big.Int).Add(one, y)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, ed25519FieldPrime)
+	denominator.ModInverse(denominator, ed25519FieldPrime)
+
+	u := new(big.Int).Mul(numerator, denominator)
+	u.Mod(u, ed25519FieldPrime)
+
+	uBytes := u.Bytes()
+	for i := 0; i < len(uBytes) && i < 32; i++ {
+		out[i] = uBytes[len(uBytes)-1-i]
+	}
+	return
+}
+
+// ed25519PrivateKeyToCurve25519 derives the Curve25519 (X25519) private
+// scalar corresponding to an Ed25519 private key. Ed25519 itself computes
+// its signing scalar by hashing the seed with SHA-512 and clamping the
+// first half of the digest; that scalar is exactly the X25519 private key
+// for the birationally-equivalent Montgomery point.
+func ed25519PrivateKeyToCurve25519(priv ed25519.PrivateKey) (out [32]byte, err error) {
+	if len(priv) != ed25519.PrivateKeySize {
+		err = fmt.Errorf("invalid ed25519 private key")
+		return
+	}
+	digest := sha512.Sum512(priv.Seed())
+	copy(out[:], digest[:32])
+	out[0] &= 248
+	out[31] &= 127
+	out[31] |= 64
+	return
+}
+
+// reverseBytes returns a copy of b with the byte order reversed, used to
+// flip between the little-endian encoding SSH/Ed25519 use and the
+// big-endian encoding math/big expects.
+func reverseBytes(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, v := range b {
+		out[len(b)-1-i] = v
+	}
+	return out
+}